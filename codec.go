@@ -0,0 +1,42 @@
+package webHandler
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+)
+
+/*
+ * JSONCodec is a built in Codec that encodes and decodes messages as JSON text.
+ */
+type JSONCodec struct {
+	// NewMessage returns a new, zero valued pointer for Decode to unmarshal
+	// an incoming message into, e.g. func() any { return new(MyMessage) }
+	NewMessage func() any
+}
+
+/*
+ * Encode v as JSON text
+ * @param v {any} the message to encode
+ * @return {[]byte} the JSON encoded bytes
+ * @return {int} always websocket.TextMessage
+ * @return {error} any error returned by json.Marshal
+ */
+func (c JSONCodec) Encode(v any) ([]byte, int, error) {
+	data, err := json.Marshal(v)
+	return data, websocket.TextMessage, err
+}
+
+/*
+ * Decode JSON text into a new value obtained from NewMessage
+ * @param data {[]byte} the JSON bytes received on the websocket
+ * @param msgType {int} unused, present to satisfy the Codec interface
+ * @return {any} the value returned by NewMessage, populated by json.Unmarshal
+ * @return {error} any error returned by json.Unmarshal
+ */
+func (c JSONCodec) Decode(data []byte, msgType int) (any, error) {
+	v := c.NewMessage()
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,59 @@
+package webHandler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// ClientIDParam is the URL query parameter a client may set to supply its own
+	// ClientID when establishing (or re-establishing) a websocket connection.
+	// Takes precedence over ClientIDHeader. This value is entirely client-supplied
+	// and never verified by the webHandler, so any connection that can reach this
+	// endpoint can claim any ClientID - including one already in use - and both
+	// receive messages sent to it (SendToClient/WebHandler.SendTo) and resume its
+	// pending reconnect backlog. Callers that need ClientIDs to be trustworthy must
+	// authenticate the client some other way before relying on it.
+	ClientIDParam = "client_id"
+	// ClientIDHeader is the HTTP header a client may set to supply its own ClientID
+	// when establishing (or re-establishing) a websocket connection. Subject to the
+	// same caveat as ClientIDParam: it is never verified by the webHandler.
+	ClientIDHeader = "X-Client-Id"
+	// clientIDMessagePrefix marks the text message sent to a client immediately after
+	// connecting, echoing back the ClientID it is now associated with - its own, if
+	// supplied via ClientIDParam/ClientIDHeader, or one freshly minted by the webHandler
+	clientIDMessagePrefix = "webHandler:clientID:"
+)
+
+/*
+ * Determine the ClientID for an incoming connection
+ * @param r {*http.Request}
+ * @return {string} the ClientID supplied via ClientIDParam or ClientIDHeader, or a
+ *         freshly minted one if neither is set
+ */
+func clientIDFromRequest(r *http.Request) string {
+	if id := r.URL.Query().Get(ClientIDParam); id != "" {
+		return id
+	}
+	if id := r.Header.Get(ClientIDHeader); id != "" {
+		return id
+	}
+	return newClientID()
+}
+
+/*
+ * Mint a new, random ClientID
+ * @return {string}
+ */
+func newClientID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		//crypto/rand failing is exceedingly rare; fall back to a timestamp based id
+		// rather than leaving the connection without a ClientID
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
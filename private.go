@@ -11,20 +11,66 @@ import (
 // to the handleWebsocketReceive function
 type cmdStruct struct {
 	msg []byte
+	msgType int
+	id string
 	h   SocketHandler
 	ws  *websocket.Conn
 }
 
+// outboundBufferSize is the capacity of each client's outbound message channel.
+// A client whose writer goroutine cannot keep up and fills this buffer is
+// considered slow and is dropped rather than blocking the dispatcher.
+const outboundBufferSize = 16
+
+// outboundMsg is a message queued for writing to a client's websocket,
+// along with the websocket message type it should be written as
+type outboundMsg struct {
+	data []byte
+	msgType int
+}
+
+// client bundles the SocketHandler and ClientID assigned to a websocket with the
+// buffered outbound channel its writer go routine reads from. Keeping these
+// together lets the dispatcher in handleWebsocketSend look them up with a single
+// map access while holding only a read lock.
+type client struct {
+	handle SocketHandler
+	id     string
+	send   chan outboundMsg
+}
+
+/*
+ * Decode the raw bytes of an incoming message using the configured Codec. If no
+ * Codec was supplied to InitWebHandler, the raw []byte is returned unchanged.
+ * @param m {*cmdStruct} the received message
+ * @return {any} the decoded message
+ * @return {error} any error returned by Codec.Decode
+ */
+func (wh *WebHandler) decode(m *cmdStruct) (any, error) {
+	if wh.codec == nil {
+		return m.msg, nil
+	}
+	return wh.codec.Decode(m.msg, m.msgType)
+}
+
 /*
  * Creates the http handler function for establishing websocket connections
  * @param sh {SocketHandler} the handler that will be assigned to websockets using this HandlerFunc
  * @param timeout {time.Duration} the timeout for receiving incoming messages on the websocket and
  *        passing them on the the control loop
+ * @param pongWait {time.Duration} the read deadline to apply to the websocket, refreshed on every
+ *        pong message. A value <= 0, or a pingPeriod <= 0, disables the read deadline.
+ * @param pingPeriod {time.Duration} the interval between keepalive pings sent by the client's
+ *        writer go routine. A value <= 0 disables the keepalive ping/pong subsystem.
+ * @param writeWait {time.Duration} the deadline applied to every write on the websocket, including pings
+ * @param reconnectGrace {time.Duration} how long to retain a disconnected client's outbound
+ *        queue under its ClientID so a reconnect can resume delivery. A value <= 0 drops
+ *        disconnected clients immediately.
  * @return {http.HandlerFunc}
  */
-func (wh *WebHandler) makeConnectHandler(sh SocketHandler, timeout time.Duration) http.HandlerFunc {
+func (wh *WebHandler) makeConnectHandler(sh SocketHandler, timeout time.Duration, pongWait time.Duration, pingPeriod time.Duration, writeWait time.Duration, reconnectGrace time.Duration) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		wh.handleConnection(w, r, sh, timeout)
+		wh.handleConnection(w, r, sh, timeout, pongWait, pingPeriod, writeWait, reconnectGrace)
 	}
 	return fn
 }
@@ -62,13 +108,18 @@ loop:
 	for {
 		select {
 		case m, ok := <-wh.webReceive:
-			if ok {
-				tr := Transmitter{wt: wh.webTransmit, maxMode: Socket, ws: m.ws, sh: m.h}
-				sc.Message(m.msg, m.h, tr)
-				m.h.Message(m.msg, tr)
+			if ok && !wh.tryDeliverResponse(m) {
+				decoded, err := wh.decode(m)
+				if err != nil {
+					log.Println(err)
+				} else {
+					tr := Transmitter{wt: wh.webTransmit, maxMode: Topic, ws: m.ws, sh: m.h, codec: wh.codec, id: m.id, wh: wh}
+					sc.Message(decoded, m.h, tr)
+					m.h.Message(decoded, tr)
+				}
 			}
 		//Quit the loop
-		case <-wh.exitReceive:
+		case <-wh.ctx.Done():
 			break loop
 		}
 	}
@@ -92,28 +143,36 @@ loop:
 	for {
 		select {
 		case m, ok := <-wh.webReceive:
-			if ok {
-				tr := Transmitter{wt: wh.webTransmit, maxMode: Socket, ws: m.ws, sh: m.h}
-				sc.Message(m.msg, m.h, tr)
-				m.h.Message(m.msg, tr)
+			if ok && !wh.tryDeliverResponse(m) {
+				decoded, err := wh.decode(m)
+				if err != nil {
+					log.Println(err)
+				} else {
+					tr := Transmitter{wt: wh.webTransmit, maxMode: Topic, ws: m.ws, sh: m.h, codec: wh.codec, id: m.id, wh: wh}
+					sc.Message(decoded, m.h, tr)
+					m.h.Message(decoded, tr)
+				}
 			}
 		//Handle updates to the system that should occur at a regular interval
 		case <-ticker.C:
-			tr := Transmitter{wt: wh.webTransmit, maxMode: Broadcast}
+			tr := Transmitter{wt: wh.webTransmit, maxMode: Broadcast, codec: wh.codec, wh: wh}
 			sc.Update(tr)
 			for _, sh := range sl {
-				tr = Transmitter{wt: wh.webTransmit, maxMode: Handle, sh: sh}
+				tr = Transmitter{wt: wh.webTransmit, maxMode: Handle, sh: sh, codec: wh.codec, wh: wh}
 				sh.Update(tr)
 			}
 		//Quit the loop
-		case <-wh.exitReceive:
+		case <-wh.ctx.Done():
 			break loop
 		}
 	}
 }
 
 /*
- * Run a loop to transmit status updates to the appropriate websocket connections
+ * Run a loop that dispatches status updates to the outbound channel of every
+ * matching client. This only ever performs a non-blocking channel send, so a
+ * single slow client's writer go routine can never stall delivery to the
+ * others; a client whose buffer is full is dropped instead.
  */
 func (wh *WebHandler) handleWebsocketSend() {
 
@@ -124,43 +183,207 @@ loop:
 		//through the websocket
 		case m := <-wh.webTransmit:
 
-			//A lock to avoid any conflicts with closing connections
-			wh.clientLock.Lock()
+			//A read lock is enough since dispatching only looks up the
+			// client map; dropping a client (below) takes the write lock
+			wh.clientLock.RLock()
+			var drop []*websocket.Conn
 			//Transmit to different sub-sets of the websockets depending on the
 			// code
+			om := outboundMsg{data: m.msg, msgType: m.msgType}
 			switch m.mode {
 			case Socket:
 				//Check if the websocket is still active
-				if _, ok := wh.clients[m.ws]; ok {
-					if err := m.ws.WriteMessage(websocket.TextMessage, m.msg); err != nil {
-						log.Println(err)
+				if cl, ok := wh.clients[m.ws]; ok {
+					if !trySend(cl, om) {
+						drop = append(drop, m.ws)
 					}
 				}
 			case Handle:
 				//Transmit the message to all clients
-				for ws, handle := range wh.clients {
-					if handle == m.sh {
-						if err := ws.WriteMessage(websocket.TextMessage, m.msg); err != nil {
-							log.Println(err)
+				for ws, cl := range wh.clients {
+					if cl.handle == m.sh {
+						if !trySend(cl, om) {
+							drop = append(drop, ws)
 						}
 					}
 				}
 			case Broadcast:
 				//Transmit the message to all clients
-				for ws, _ := range wh.clients {
-					if err := ws.WriteMessage(websocket.TextMessage, m.msg); err != nil {
-						log.Println(err)
+				for ws, cl := range wh.clients {
+					if !trySend(cl, om) {
+						drop = append(drop, ws)
+					}
+				}
+			case Client:
+				//Transmit the message to any/all clients with a matching ClientID
+				for ws, cl := range wh.clients {
+					if cl.id == m.targetID {
+						if !trySend(cl, om) {
+							drop = append(drop, ws)
+						}
+					}
+				}
+			case Topic:
+				//Transmit the message to every client subscribed to the target topic
+				for _, ws := range wh.topics.subscribers(m.targetTopic) {
+					if cl, ok := wh.clients[ws]; ok {
+						if !trySend(cl, om) {
+							drop = append(drop, ws)
+						}
 					}
 				}
 			}
-			wh.clientLock.Unlock()
+			wh.clientLock.RUnlock()
+
+			if len(drop) > 0 {
+				wh.clientLock.Lock()
+				for _, ws := range drop {
+					log.Println("dropping client: outbound buffer full")
+					wh.dropClient(ws)
+				}
+				wh.clientLock.Unlock()
+			}
 		//Quit the loop
-		case <-wh.exitTransmit:
+		case <-wh.ctx.Done():
 			break loop
 		}
 	}
 }
 
+/*
+ * Attempt a non-blocking send of msg to the client's outbound channel
+ * @param cl {*client} the client to send to
+ * @param msg {outboundMsg} the message to send
+ * @return {bool} false if the client's outbound buffer is full and the message was dropped
+ */
+func trySend(cl *client, msg outboundMsg) bool {
+	select {
+	case cl.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Remove a websocket from the client map, unsubscribe it from every topic, close
+ * its outbound channel (which signals its writer go routine to stop), and close
+ * the underlying connection. The caller must hold the clientLock write lock.
+ * @param ws {*websocket.Conn} the websocket to drop
+ */
+func (wh *WebHandler) dropClient(ws *websocket.Conn) {
+	if cl, ok := wh.clients[ws]; ok {
+		delete(wh.clients, ws)
+		close(cl.send)
+	}
+	wh.topics.unsubscribeAll(ws)
+	ws.Close()
+}
+
+/*
+ * Detach ws from the client map and unsubscribe it from every topic when its reader
+ * loop exits, the way dropClient does. Unlike dropClient though, if grace > 0 the
+ * client's outbound channel (and any
+ * backlog already queued on it) is retained in the pending map under its ClientID
+ * instead of being closed immediately, so that a reconnect with the same ClientID
+ * within the grace window resumes delivery rather than starting over.
+ * The caller must hold the clientLock write lock.
+ * @param ws {*websocket.Conn} the websocket being disconnected
+ * @param cl {*client} the client state for ws
+ * @param grace {time.Duration} how long to retain cl for a possible reconnect. A value
+ *        <= 0 drops the client immediately, same as dropClient
+ */
+func (wh *WebHandler) retainOrDrop(ws *websocket.Conn, cl *client, grace time.Duration) {
+	//Already dropped by dropClient or Shutdown, which closed cl.send themselves
+	if _, ok := wh.clients[ws]; !ok {
+		wh.topics.unsubscribeAll(ws)
+		ws.Close()
+		return
+	}
+	delete(wh.clients, ws)
+	wh.topics.unsubscribeAll(ws)
+	ws.Close()
+
+	if grace <= 0 {
+		close(cl.send)
+		return
+	}
+
+	wh.pending[cl.id] = cl
+	time.AfterFunc(grace, func() {
+		wh.clientLock.Lock()
+		//Only clean up if a reconnect hasn't already claimed this client
+		if wh.pending[cl.id] == cl {
+			delete(wh.pending, cl.id)
+			close(cl.send)
+		}
+		wh.clientLock.Unlock()
+	})
+}
+
+/*
+ * Run a per-connection loop that serializes all writes to a single websocket:
+ * outbound messages dispatched to the client's channel, and keepalive pings
+ * sent on a regular interval. Serializing writes this way keeps the handler
+ * compliant with RFC 6455, which forbids concurrent writes to one connection.
+ * done is closed by handleConnection as soon as ws's reader loop exits, which
+ * stops this pump even if cl.send lives on (e.g. retained across a reconnect
+ * grace window) - cl.send is reused by the resumed connection's own writePump,
+ * so this one must not go on selecting on it.
+ * @param ws {*websocket.Conn} the websocket this pump owns
+ * @param cl {*client} the client state (outbound channel) for ws
+ * @param done {<-chan struct{}} closed when ws's connection is done, independently
+ *        of whether cl.send is retained for a reconnect
+ * @param pingPeriod {time.Duration} the interval between keepalive pings. A value <= 0
+ *        disables the keepalive ping/pong subsystem.
+ * @param writeWait {time.Duration} the deadline applied to every write, including pings
+ */
+func (wh *WebHandler) writePump(ws *websocket.Conn, cl *client, done <-chan struct{}, pingPeriod time.Duration, writeWait time.Duration) {
+
+	defer wh.wsWG.Done()
+
+	//A ticker for sending keepalive pings. Left nil (and its channel never ready)
+	// if the keepalive subsystem is disabled
+	var pingTicker *time.Ticker
+	var pingC <-chan time.Time
+	if pingPeriod > 0 {
+		pingTicker = time.NewTicker(pingPeriod)
+		defer pingTicker.Stop()
+		pingC = pingTicker.C
+	}
+
+	for {
+		select {
+		case msg, ok := <-cl.send:
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				//The client was dropped; tell the peer and stop
+				ws.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := ws.WriteMessage(msg.msgType, msg.data); err != nil {
+				log.Println(err)
+				wh.clientLock.Lock()
+				wh.dropClient(ws)
+				wh.clientLock.Unlock()
+				return
+			}
+		case <-pingC:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				log.Println(err)
+				wh.clientLock.Lock()
+				wh.dropClient(ws)
+				wh.clientLock.Unlock()
+				return
+			}
+		case <-done:
+			return
+		case <-wh.ctx.Done():
+			return
+		}
+	}
+}
+
 /*
  * Static function for handling incomming connections to the motor controllers
  * @param w (http.ResponseWriter)
@@ -168,18 +391,30 @@ loop:
  * @param handle (SocketHandler) an interface to handle the system
  * @param timeout {time.Duration} the timeout for receiving incoming messages on the websocket and
  *        passing them on the the control loop
+ * @param pongWait {time.Duration} the read deadline to apply to the websocket, refreshed on every
+ *        pong message. A value <= 0, or a pingPeriod <= 0, disables the read deadline.
+ * @param pingPeriod {time.Duration} the interval between keepalive pings sent by this
+ *        connection's writer go routine. A value <= 0 disables the keepalive ping/pong subsystem.
+ * @param writeWait {time.Duration} the deadline applied to every write on the websocket, including pings
+ * @param reconnectGrace {time.Duration} how long to retain a disconnected client's outbound
+ *        queue under its ClientID so a reconnect can resume delivery. A value <= 0 drops
+ *        disconnected clients immediately.
  */
-func (wh *WebHandler) handleConnection(w http.ResponseWriter, r *http.Request, handle SocketHandler, timeout time.Duration) {
+func (wh *WebHandler) handleConnection(w http.ResponseWriter, r *http.Request, handle SocketHandler, timeout time.Duration, pongWait time.Duration, pingPeriod time.Duration, writeWait time.Duration, reconnectGrace time.Duration) {
 
 	//bypassing the error
 	r.Header.Del("Origin")
 
+	// The ClientID this connection is (or is re-)associated with, supplied by the
+	// client or freshly minted
+	clientID := clientIDFromRequest(r)
+
 	wh.clientLock.Lock()
 
 	// In case the shutdown method has been called,
 	// return immediately
 	select {
-	case <-wh.doneConn:
+	case <-wh.ctx.Done():
 		wh.clientLock.Unlock()
 		return
 	default:
@@ -195,36 +430,65 @@ func (wh *WebHandler) handleConnection(w http.ResponseWriter, r *http.Request, h
 		return
 	}
 
-	wh.clients[ws] = handle
+	// Set up the keepalive read deadline and extend it on every pong received
+	if pongWait > 0 && pingPeriod > 0 {
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		ws.SetPongHandler(func(string) error {
+			ws.SetReadDeadline(time.Now().Add(pongWait))
+			return nil
+		})
+	}
+
+	// If a client with this ClientID disconnected within its grace window, resume
+	// its retained outbound channel (and any backlog already queued on it) instead
+	// of starting a fresh one
+	cl, resumed := wh.pending[clientID]
+	if resumed {
+		delete(wh.pending, clientID)
+		cl.handle = handle
+	} else {
+		cl = &client{handle: handle, id: clientID, send: make(chan outboundMsg, outboundBufferSize)}
+	}
+	wh.clients[ws] = cl
+	//Let the client know which ClientID it is now associated with
+	trySend(cl, outboundMsg{data: []byte(clientIDMessagePrefix + clientID), msgType: websocket.TextMessage})
 	wh.clientLock.Unlock()
 
+	// The writer go routine owns all writes to ws, so the ping ticker and
+	// every dispatched message are serialized through it. done is closed below
+	// as soon as this connection's reader loop exits, so this specific pump
+	// always stops there, even if cl.send is retained under reconnectGrace for
+	// a future connection (with its own writePump) to resume.
+	done := make(chan struct{})
+	wh.wsWG.Add(1)
+	go wh.writePump(ws, cl, done, pingPeriod, writeWait)
+
 	defer func() {
+		close(done)
 		wh.clientLock.Lock()
-		delete(wh.clients, ws)
+		wh.retainOrDrop(ws, cl, reconnectGrace)
 		wh.clientLock.Unlock()
-		// Make sure we close the  connection when the function returns
-		ws.Close()
 		wh.wsWG.Done()
 	}()
 
 loop:
 	for {
-		_, message, err := ws.ReadMessage()
+		msgType, message, err := ws.ReadMessage()
 
 		//If there is an error, delete the websocket connection
 		if err == nil {
 			if timeout > 0 {
 				select {
-				case wh.webReceive <- &cmdStruct{msg: message, h: handle, ws: ws}:
+				case wh.webReceive <- &cmdStruct{msg: message, msgType: msgType, id: clientID, h: handle, ws: ws}:
 				//
 				case <-time.After(timeout):
-				case <-wh.exitReceive:
+				case <-wh.ctx.Done():
 					break loop
 				}
 			} else {
 				select {
-				case wh.webReceive <- &cmdStruct{msg: message, h: handle, ws: ws}:
-				case <-wh.exitReceive:
+				case wh.webReceive <- &cmdStruct{msg: message, msgType: msgType, id: clientID, h: handle, ws: ws}:
+				case <-wh.ctx.Done():
 					break loop
 				}
 			}
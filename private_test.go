@@ -0,0 +1,190 @@
+package webHandler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServerConn spins up an httptest.Server that upgrades every request to a
+// websocket, dials it, and hands back both ends so a test can drive them directly
+// without a full WebHandler/SystemCommander around them. The caller must close srv
+// and the client connection; the server connection is closed by the code under test.
+func newTestServerConn(t *testing.T) (serverWS, clientWS *websocket.Conn, srv *httptest.Server) {
+	t.Helper()
+
+	connCh := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		connCh <- ws
+	}))
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	clientWS, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("dial: %v", err)
+	}
+	serverWS = <-connCh
+	return serverWS, clientWS, srv
+}
+
+// TestWritePumpStaleConnectionStopsOnDone covers the reconnect handoff at the heart
+// of retainOrDrop/handleConnection: once a connection's own done channel is closed
+// (as handleConnection's defer does immediately, regardless of reconnectGrace), its
+// writePump must stop competing for cl.send - even though cl (and cl.send) lives on
+// and is handed to a second writePump for the resumed connection.
+func TestWritePumpStaleConnectionStopsOnDone(t *testing.T) {
+	wh := &WebHandler{ctx: context.Background()}
+
+	serverWS1, clientWS1, srv1 := newTestServerConn(t)
+	defer srv1.Close()
+	defer clientWS1.Close()
+
+	cl := &client{id: "foo", send: make(chan outboundMsg, outboundBufferSize)}
+
+	done1 := make(chan struct{})
+	wh.wsWG.Add(1)
+	go wh.writePump(serverWS1, cl, done1, 0, time.Second)
+	close(done1)
+	wh.wsWG.Wait()
+
+	serverWS2, clientWS2, srv2 := newTestServerConn(t)
+	defer srv2.Close()
+	defer clientWS2.Close()
+
+	done2 := make(chan struct{})
+	wh.wsWG.Add(1)
+	go wh.writePump(serverWS2, cl, done2, 0, time.Second)
+	defer close(done2)
+
+	cl.send <- outboundMsg{data: []byte("hello"), msgType: websocket.TextMessage}
+
+	clientWS2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := clientWS2.ReadMessage()
+	if err != nil {
+		t.Fatalf("resumed connection did not receive the message: %v", err)
+	}
+	if string(msg) != "hello" {
+		t.Fatalf("got %q, want %q", msg, "hello")
+	}
+
+	clientWS1.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := clientWS1.ReadMessage(); err == nil {
+		t.Fatalf("stale connection's writePump was still alive and consumed the message")
+	}
+}
+
+// TestDropClient checks that dropClient removes the connection from the client map,
+// unsubscribes it from every topic, and closes its outbound channel so the
+// connection's writePump stops.
+func TestDropClient(t *testing.T) {
+	wh := &WebHandler{
+		clients: make(map[*websocket.Conn]*client),
+		pending: make(map[string]*client),
+		topics:  newTopicRegistry(),
+	}
+
+	serverWS, clientWS, srv := newTestServerConn(t)
+	defer srv.Close()
+	defer clientWS.Close()
+
+	cl := &client{id: "foo", send: make(chan outboundMsg, outboundBufferSize)}
+	wh.clients[serverWS] = cl
+	wh.topics.subscribe(serverWS, "a.b")
+
+	wh.dropClient(serverWS)
+
+	if _, ok := wh.clients[serverWS]; ok {
+		t.Fatalf("dropClient left the connection in the client map")
+	}
+	if subs := wh.topics.subscribers("a.b"); len(subs) != 0 {
+		t.Fatalf("dropClient left the connection subscribed to a topic")
+	}
+	if _, ok := <-cl.send; ok {
+		t.Fatalf("dropClient did not close the outbound channel")
+	}
+}
+
+// TestRetainOrDropGraceWindow checks that a client disconnected with grace > 0 is
+// retained under its ClientID until the grace window elapses, at which point it is
+// evicted and its outbound channel closed - unless a reconnect claims it first.
+func TestRetainOrDropGraceWindow(t *testing.T) {
+	wh := &WebHandler{
+		clients: make(map[*websocket.Conn]*client),
+		pending: make(map[string]*client),
+		topics:  newTopicRegistry(),
+	}
+
+	serverWS, clientWS, srv := newTestServerConn(t)
+	defer srv.Close()
+	defer clientWS.Close()
+
+	cl := &client{id: "foo", send: make(chan outboundMsg, outboundBufferSize)}
+	wh.clients[serverWS] = cl
+
+	wh.clientLock.Lock()
+	wh.retainOrDrop(serverWS, cl, 50*time.Millisecond)
+	wh.clientLock.Unlock()
+
+	wh.clientLock.RLock()
+	pending, ok := wh.pending["foo"]
+	wh.clientLock.RUnlock()
+	if !ok || pending != cl {
+		t.Fatalf("retainOrDrop did not retain the client under its ClientID")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	wh.clientLock.RLock()
+	_, stillPending := wh.pending["foo"]
+	wh.clientLock.RUnlock()
+	if stillPending {
+		t.Fatalf("retainOrDrop did not evict the client once its grace window elapsed")
+	}
+	if _, ok := <-cl.send; ok {
+		t.Fatalf("retainOrDrop did not close the outbound channel on eviction")
+	}
+}
+
+// TestRetainOrDropReconnectClaimsPending checks that a reconnect (simulated here by
+// deleting from pending the way handleConnection does) prevents the grace timer from
+// evicting the client or closing its outbound channel out from under the new connection.
+func TestRetainOrDropReconnectClaimsPending(t *testing.T) {
+	wh := &WebHandler{
+		clients: make(map[*websocket.Conn]*client),
+		pending: make(map[string]*client),
+		topics:  newTopicRegistry(),
+	}
+
+	serverWS, clientWS, srv := newTestServerConn(t)
+	defer srv.Close()
+	defer clientWS.Close()
+
+	cl := &client{id: "foo", send: make(chan outboundMsg, outboundBufferSize)}
+	wh.clients[serverWS] = cl
+
+	wh.clientLock.Lock()
+	wh.retainOrDrop(serverWS, cl, 50*time.Millisecond)
+	// Simulate a reconnect claiming the pending client before the grace timer fires
+	delete(wh.pending, "foo")
+	wh.clientLock.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+
+	select {
+	case _, ok := <-cl.send:
+		t.Fatalf("grace timer closed the outbound channel after a reconnect claimed it (ok=%v)", ok)
+	default:
+	}
+}
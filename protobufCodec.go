@@ -0,0 +1,48 @@
+package webHandler
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+ * ProtobufCodec is a built in Codec that encodes and decodes messages as
+ * binary Protocol Buffers.
+ */
+type ProtobufCodec struct {
+	// NewMessage returns a new, zero valued instance for Decode to unmarshal
+	// an incoming message into, e.g. func() proto.Message { return new(pb.MyMessage) }
+	NewMessage func() proto.Message
+}
+
+/*
+ * Encode v as a binary Protocol Buffer message
+ * @param v {any} the message to encode. Must implement proto.Message
+ * @return {[]byte} the Protobuf encoded bytes
+ * @return {int} always websocket.BinaryMessage
+ * @return {error} an error if v does not implement proto.Message, or any error returned by proto.Marshal
+ */
+func (c ProtobufCodec) Encode(v any) ([]byte, int, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, 0, fmt.Errorf("webHandler: ProtobufCodec.Encode: %T does not implement proto.Message", v)
+	}
+	data, err := proto.Marshal(m)
+	return data, websocket.BinaryMessage, err
+}
+
+/*
+ * Decode a binary Protocol Buffer message into a new value obtained from NewMessage
+ * @param data {[]byte} the Protobuf bytes received on the websocket
+ * @param msgType {int} unused, present to satisfy the Codec interface
+ * @return {any} the value returned by NewMessage, populated by proto.Unmarshal
+ * @return {error} any error returned by proto.Unmarshal
+ */
+func (c ProtobufCodec) Decode(data []byte, msgType int) (any, error) {
+	m := c.NewMessage()
+	if err := proto.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -1,51 +1,66 @@
 package webHandler
 
 import(
+	"context"
 	"net/http"
 	"github.com/gorilla/websocket"
 	"time"
 )
 
 /*
+ * @param ctx {context.Context} the parent context for the webHandler's lifecycle, e.g. one
+ *        from signal.NotifyContext. Cancelling it stops the receive loop (which then calls
+ *        SystemCommander.Stop), the transmit dispatcher and every connection's writer go
+ *        routine. Unlike Shutdown, it does not close open websocket connections or wait for
+ *        them to drain.
  * @param sc {SystemCommander} The overall commander for the system. Used to handle general control of the system.
- * @param hm {map[string] SocketHandler} Handles each individual system that could be accessed by a separate websocket. 
+ * @param hm {map[string] SocketHandler} Handles each individual system that could be accessed by a separate websocket.
+ * @param codec {Codec} used to encode/decode messages so handlers can work with typed message
+ *        structs instead of raw []byte. Pass nil to leave messages as raw []byte, as before.
  * @returns {*WebHandler} the overall handler for the system. Can be used to access the map of functions for controlling the websockets.
  * @returns {error} any errors that occurred
  */
-func InitWebHandler(sc SystemCommander, hm map[string]SocketHandler) (*WebHandler, error) {
+func InitWebHandler(ctx context.Context, sc SystemCommander, hm map[string]SocketHandler, codec Codec) (*WebHandler, error) {
+	var whCtx, cancel = context.WithCancel(ctx)
 	var wh *WebHandler = &WebHandler {
-		exitReceive  : make(chan struct{}),
-		exitTransmit : make(chan struct{}),
+		ctx          : whCtx,
+		cancel       : cancel,
 		finishedExit : make(chan struct{}),
-		doneConn     : make(chan struct{}),
 		webTransmit  : make(chan Transmitter, 10),
 		webReceive   : make(chan *cmdStruct, 5),
-		clients      : make(map[*websocket.Conn] SocketHandler),
+		clients      : make(map[*websocket.Conn] *client),
+		pending      : make(map[string] *client),
+		topics       : newTopicRegistry(),
 		wFuncs       : make(WebFuncs),
+		codec        : codec,
 	}
-		
-	// Create a map of transmitters to allow for transmitting 
+
+	// Create a map of transmitters to allow for transmitting
 	// messages along the websockets for each SocketHandler
 	var tm map[string]Transmitter = make(map[string]Transmitter)
 	for s, h := range hm {
-		tm[s] = Transmitter{maxMode: Handle, sh:h, wt:wh.webTransmit}
+		tm[s] = Transmitter{maxMode: Handle, sh:h, wt:wh.webTransmit, codec: wh.codec, wh: wh}
 	}
 		
 	if err := sc.Start(tm); err != nil {
 		return nil, err
 	}
 	// Create the handler funcs for each SocketHandler and the list of socket handlers
-	// Provide the timeout supplied by the SystemCommander
+	// Provide the timeout and keepalive settings supplied by the SystemCommander
 	var sl []SocketHandler = []SocketHandler{}
 	var timeout time.Duration = sc.MessageTimeout()
+	var pongWait time.Duration = sc.PongWait()
+	var pingPeriod time.Duration = sc.PingPeriod()
+	var writeWait time.Duration = sc.WriteWait()
+	var reconnectGrace time.Duration = sc.ReconnectGrace()
 	for s, h := range hm {
 		sl = append(sl, h)
-		wh.wFuncs[s] = wh.makeConnectHandler(h, timeout)
+		wh.wFuncs[s] = wh.makeConnectHandler(h, timeout, pongWait, pingPeriod, writeWait, reconnectGrace)
 	}
-	
+
 	//go routines for synchronizing receiving and transmitting messages
 	// from the websocket
-	go wh.handleWebsocketSend()	
+	go wh.handleWebsocketSend()
 	go wh.handleWebsocketReceive(sc,sl, sc.UpdateFrequency())
 	
 	return wh, nil
@@ -76,36 +91,109 @@ func (wh *WebHandler) GetWebFunc(s string) http.HandlerFunc {
 	return wh.wFuncs[s]
 }
 
-/* 
- * Shutdown the websocket connections and close the system
- * Shutdown may only be called once. It will panic if called multiple times.
+/*
+ * Send data directly to any/all currently live websocket(s) whose ClientID matches
+ * clientID, bypassing the webTransmit dispatch channel. This is the WebHandler-level
+ * equivalent of Transmitter.SendToClient, for use by callers that only have a
+ * *WebHandler (e.g. an HTTP handler reacting to some external event).
+ * @param clientID {string} the ClientID to target, see Transmitter.GetClientID
+ * @param data {[]byte}
+ * @return {bool} whether at least one live client matching clientID was sent to
  */
-func (wh *WebHandler) Shutdown() {
-
-	/*Closing must be done in order, starting with stopping all new connections, 
-	 * then closing all connections,
-	 * then closing the message receiver go routine, 
-	 * then closing the driver port(s),
-   	 * then closing the message transmitter go routine.
-     */
-	wh.clientLock.Lock()
-	close(wh.doneConn)
-	for k := range wh.clients {
-		k.Close()
+func (wh *WebHandler) SendTo(clientID string, data []byte) bool {
+	wh.clientLock.RLock()
+	defer wh.clientLock.RUnlock()
+
+	var sent bool = false
+	for _, cl := range wh.clients {
+		if cl.id == clientID {
+			if trySend(cl, outboundMsg{data: data, msgType: websocket.TextMessage}) {
+				sent = true
+			}
+		}
 	}
-	// This clears all websocket from the map
-	wh.clients = make(map[*websocket.Conn] SocketHandler)
-	wh.clientLock.Unlock()
-	
-	//Wait until all HandleConnection functions have completed
-	wh.wsWG.Wait()
+	return sent
+}
+
+/*
+ * Publish data directly to every currently live websocket subscribed to topic
+ * (including via wildcard subscriptions, see Transmitter.Subscribe), bypassing the
+ * webTransmit dispatch channel. This is the WebHandler-level equivalent of
+ * Transmitter.SendTopic, for use by callers that only have a *WebHandler.
+ * @param topic {string} the topic to publish on
+ * @param data {[]byte}
+ * @return {bool} whether at least one live subscriber was sent to
+ */
+func (wh *WebHandler) Publish(topic string, data []byte) bool {
+	wh.clientLock.RLock()
+	defer wh.clientLock.RUnlock()
+
+	var sent bool = false
+	for _, ws := range wh.topics.subscribers(topic) {
+		if cl, ok := wh.clients[ws]; ok {
+			if trySend(cl, outboundMsg{data: data, msgType: websocket.TextMessage}) {
+				sent = true
+			}
+		}
+	}
+	return sent
+}
+
+/*
+ * Shutdown the websocket connections and close the system. Shutdown is safe to call more
+ * than once; every call after the first simply returns the result of the first call.
+ * @param ctx {context.Context} bounds how long Shutdown waits for connections to drain and
+ *        for the receive loop to exit. If ctx is done first, Shutdown returns ctx.Err()
+ *        without waiting any further.
+ * @return {error} ctx.Err() if ctx is done before shutdown completes, nil otherwise
+ */
+func (wh *WebHandler) Shutdown(ctx context.Context) error {
+
+	wh.shutdownOnce.Do(func() {
+		/*Closing must be done in order, starting with stopping all new connections,
+		 * then closing all connections,
+		 * then closing the message receiver go routine,
+		 * then closing the driver port(s),
+	   	 * then closing the message transmitter go routine.
+	     */
+
+		// Cancelling the internal context stops new connections being accepted
+		// and signals every go routine (receive loop, transmit dispatcher,
+		// and the readers/writers for each connection) to exit
+		wh.cancel()
+
+		wh.clientLock.Lock()
+		for ws, cl := range wh.clients {
+			ws.Close()
+			close(cl.send)
+		}
+		// This clears all websockets from the map
+		wh.clients = make(map[*websocket.Conn] *client)
+		for id, cl := range wh.pending {
+			close(cl.send)
+			delete(wh.pending, id)
+		}
+		wh.clientLock.Unlock()
 
-	//Try to close the channel by waiting for all remaining
-	//roboclaw operations to complete. Give a timeout of 5 seconds
-	//to ensure that the program exits.
-	close(wh.exitReceive)
+		//Wait until all HandleConnection functions have completed, bounded by ctx
+		drained := make(chan struct{})
+		go func() {
+			wh.wsWG.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			wh.shutdownErr = ctx.Err()
+			return
+		}
 
-	//Wait for the goroutine for handling commands to quit,
-	<-wh.finishedExit
-	close(wh.exitTransmit)
+		//Wait for the receive go routine to call SystemCommander.Stop and quit, bounded by ctx
+		select {
+		case <-wh.finishedExit:
+		case <-ctx.Done():
+			wh.shutdownErr = ctx.Err()
+		}
+	})
+	return wh.shutdownErr
 }
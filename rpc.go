@@ -0,0 +1,140 @@
+package webHandler
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errNoWebHandler is returned by Transmitter.Request when called on a Transmitter
+// that wasn't issued by a webHandler (and so has no way to register the pending request)
+var errNoWebHandler = errors.New("webHandler: Request requires a Transmitter issued by the webHandler")
+
+// errRequestNotSent is returned by Transmitter.Request when the framed request
+// could not be dispatched, e.g. an invalid mode for this Transmitter
+var errRequestNotSent = errors.New("webHandler: Request failed to send")
+
+// errRequestTimeout is returned by Transmitter.Request when no matching response
+// frame arrives before the given timeout elapses
+var errRequestTimeout = errors.New("webHandler: Request timed out waiting for a response")
+
+const (
+	frameTypeRequest  = "request"
+	frameTypeResponse = "response"
+)
+
+// frame is the JSON-RPC-style envelope layered over the existing byte stream for
+// Transmitter.Request and the response it waits on. It is orthogonal to the
+// configured Codec: Payload is the raw message bytes, Codec never sees the
+// envelope itself
+type frame struct {
+	ID      uint64 `json:"id"`
+	Type    string `json:"type"`
+	Payload []byte `json:"payload"`
+}
+
+// pendingRequest is the bookkeeping stored in WebHandler.pendingRequests for an
+// in-flight Transmitter.Request call: the channel its caller is blocked reading
+// from, and enough of the request's own target (mirroring SendWithType's mode
+// check) to verify a response frame actually comes from a connection the
+// request was sent to, rather than being accepted from whichever connection
+// happens to guess the next sequential id.
+type pendingRequest struct {
+	resp chan []byte
+	mode uint8
+	ws   *websocket.Conn
+	sh   SocketHandler
+}
+
+/*
+ * Report whether a response frame read from m's connection may fulfil this
+ * pendingRequest, based on the mode the original request was sent with: Socket
+ * requires the exact same connection, Handle requires the same SocketHandler,
+ * and Broadcast (sent to every connection) accepts a response from any of them.
+ * @param m {*cmdStruct} the incoming message the response frame was read from
+ * @return {bool}
+ */
+func (pr *pendingRequest) matches(m *cmdStruct) bool {
+	switch pr.mode {
+	case Socket:
+		return m.ws == pr.ws
+	case Handle:
+		return m.h == pr.sh
+	default:
+		return true
+	}
+}
+
+/*
+ * Issue a server-initiated request and block until a response frame with a matching
+ * id arrives, or timeout elapses. payload is framed as {id, type: "request", payload}
+ * and written to the websocket(s) selected by mode; the reply is expected to be a
+ * frame carrying the same id with type "response", e.g. echoed back by the client.
+ * @param payload {[]byte} the request payload to send
+ * @param mode {uint8} the mode to use for the Transmitter, see Send
+ * @param timeout {time.Duration} how long to wait for a matching response before giving up
+ * @return {[]byte} the Payload of the matching response frame
+ * @return {error} errNoWebHandler if this Transmitter wasn't issued by a webHandler,
+ *        errRequestNotSent if the request could not be dispatched (see SendWithType),
+ *        errRequestTimeout if no matching response arrives within timeout
+ */
+func (t Transmitter) Request(payload []byte, mode uint8, timeout time.Duration) ([]byte, error) {
+	if t.wh == nil {
+		return nil, errNoWebHandler
+	}
+
+	id := atomic.AddUint64(&t.wh.nextRequestID, 1)
+	pr := &pendingRequest{resp: make(chan []byte, 1), mode: mode, ws: t.ws, sh: t.sh}
+	t.wh.pendingRequests.Store(id, pr)
+	defer t.wh.pendingRequests.Delete(id)
+
+	data, err := json.Marshal(frame{ID: id, Type: frameTypeRequest, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	if !t.SendWithType(data, mode, websocket.TextMessage) {
+		return nil, errRequestNotSent
+	}
+
+	select {
+	case payload := <-pr.resp:
+		return payload, nil
+	case <-time.After(timeout):
+		return nil, errRequestTimeout
+	}
+}
+
+/*
+ * Attempt to interpret m's message as a response frame matching a pending
+ * Transmitter.Request call sent to m's connection, delivering its payload to the
+ * waiting caller. Called by the receive loop ahead of the usual decode/SocketHandler.Message
+ * dispatch, so that frames consumed here never reach SocketHandler.Message; any data that
+ * isn't a matching response frame - including a response frame whose id is pending but
+ * was targeted at a different connection, see pendingRequest.matches - is left for the
+ * usual dispatch to handle, unchanged.
+ * @param m {*cmdStruct} the received message
+ * @return {bool} whether m's message was a response frame matching a pending request
+ */
+func (wh *WebHandler) tryDeliverResponse(m *cmdStruct) bool {
+	var f frame
+	if err := json.Unmarshal(m.msg, &f); err != nil || f.Type != frameTypeResponse {
+		return false
+	}
+	v, ok := wh.pendingRequests.Load(f.ID)
+	if !ok {
+		return false
+	}
+	pr := v.(*pendingRequest)
+	if !pr.matches(m) {
+		return false
+	}
+	select {
+	case pr.resp <- f.Payload:
+	default:
+		//A response for this id is already waiting to be read; drop the duplicate
+	}
+	return true
+}
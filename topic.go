@@ -0,0 +1,150 @@
+package webHandler
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// topicNode is one segment of the topic trie. children is keyed by the literal
+// segment name, "*" (matches exactly one segment), or "#" (matches the remainder
+// of a published topic, including zero segments)
+type topicNode struct {
+	children map[string]*topicNode
+	subs     map[*websocket.Conn]struct{}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode)}
+}
+
+// topicRegistry is the trie of topic subscriptions, keyed by dot-separated topic
+// segment. It has its own lock since subscribing/publishing is independent of
+// connection registration, and is looked up once per dispatched Topic message
+// rather than linear-scanning every client
+type topicRegistry struct {
+	lock sync.RWMutex
+	root *topicNode
+}
+
+func newTopicRegistry() *topicRegistry {
+	return &topicRegistry{root: newTopicNode()}
+}
+
+func splitTopic(topic string) []string {
+	return strings.Split(topic, ".")
+}
+
+/*
+ * Subscribe ws to topic, creating any trie nodes along the path that don't already
+ * exist. topic may itself contain "*"/"#" wildcard segments, in which case ws is
+ * subscribed to that pattern rather than a literal topic.
+ * @param ws {*websocket.Conn}
+ * @param topic {string}
+ */
+func (tr *topicRegistry) subscribe(ws *websocket.Conn, topic string) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	node := tr.root
+	for _, seg := range splitTopic(topic) {
+		child, ok := node.children[seg]
+		if !ok {
+			child = newTopicNode()
+			node.children[seg] = child
+		}
+		node = child
+	}
+	if node.subs == nil {
+		node.subs = make(map[*websocket.Conn]struct{})
+	}
+	node.subs[ws] = struct{}{}
+}
+
+/*
+ * Unsubscribe ws from topic. A no-op if ws was never subscribed to topic.
+ * @param ws {*websocket.Conn}
+ * @param topic {string}
+ */
+func (tr *topicRegistry) unsubscribe(ws *websocket.Conn, topic string) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	node := tr.root
+	for _, seg := range splitTopic(topic) {
+		child, ok := node.children[seg]
+		if !ok {
+			return
+		}
+		node = child
+	}
+	delete(node.subs, ws)
+}
+
+/*
+ * Remove ws from every topic (and wildcard pattern) it is subscribed to. Called
+ * when a connection is dropped, so its subscriptions don't leak in the trie.
+ * @param ws {*websocket.Conn}
+ */
+func (tr *topicRegistry) unsubscribeAll(ws *websocket.Conn) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	var walk func(n *topicNode)
+	walk = func(n *topicNode) {
+		delete(n.subs, ws)
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(tr.root)
+}
+
+/*
+ * Collect every websocket subscribed to a pattern matching topic, including via
+ * "*" (exactly one segment) and "#" (the remainder of topic) wildcard subscriptions.
+ * @param topic {string} the topic being published on; must not itself contain wildcards
+ * @return {[]*websocket.Conn} the matching subscribers, deduplicated
+ */
+func (tr *topicRegistry) subscribers(topic string) []*websocket.Conn {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+
+	segs := splitTopic(topic)
+	seen := make(map[*websocket.Conn]struct{})
+
+	var walk func(n *topicNode, i int)
+	walk = func(n *topicNode, i int) {
+		if i == len(segs) {
+			for ws := range n.subs {
+				seen[ws] = struct{}{}
+			}
+			//"#" also matches zero further segments
+			if child, ok := n.children["#"]; ok {
+				for ws := range child.subs {
+					seen[ws] = struct{}{}
+				}
+			}
+			return
+		}
+		if child, ok := n.children[segs[i]]; ok {
+			walk(child, i+1)
+		}
+		if child, ok := n.children["*"]; ok {
+			walk(child, i+1)
+		}
+		if child, ok := n.children["#"]; ok {
+			for ws := range child.subs {
+				seen[ws] = struct{}{}
+			}
+		}
+	}
+	walk(tr.root, 0)
+
+	out := make([]*websocket.Conn, 0, len(seen))
+	for ws := range seen {
+		out = append(out, ws)
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package webHandler
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestTopicRegistryWildcardMatching exercises subscribers' wildcard matching rules:
+// a literal subscription matches only its exact topic, "*" matches exactly one
+// segment, and "#" matches any remainder (including zero further segments).
+func TestTopicRegistryWildcardMatching(t *testing.T) {
+	tr := newTopicRegistry()
+
+	literal := &websocket.Conn{}
+	star := &websocket.Conn{}
+	hash := &websocket.Conn{}
+
+	tr.subscribe(literal, "foo.bar")
+	tr.subscribe(star, "foo.*")
+	tr.subscribe(hash, "foo.#")
+
+	cases := []struct {
+		topic string
+		want  map[*websocket.Conn]bool
+	}{
+		{"foo.bar", map[*websocket.Conn]bool{literal: true, star: true, hash: true}},
+		{"foo.baz", map[*websocket.Conn]bool{star: true, hash: true}},
+		{"foo.bar.baz", map[*websocket.Conn]bool{hash: true}},
+		{"other.bar", map[*websocket.Conn]bool{}},
+	}
+
+	for _, c := range cases {
+		got := make(map[*websocket.Conn]bool)
+		for _, ws := range tr.subscribers(c.topic) {
+			got[ws] = true
+		}
+		if len(got) != len(c.want) {
+			t.Fatalf("subscribers(%q) = %v, want %v", c.topic, got, c.want)
+		}
+		for ws := range c.want {
+			if !got[ws] {
+				t.Fatalf("subscribers(%q) missing expected subscriber %p", c.topic, ws)
+			}
+		}
+	}
+}
+
+// TestTopicRegistryUnsubscribe checks that unsubscribe removes a single subscription
+// without disturbing others on the same topic.
+func TestTopicRegistryUnsubscribe(t *testing.T) {
+	tr := newTopicRegistry()
+	ws := &websocket.Conn{}
+	other := &websocket.Conn{}
+
+	tr.subscribe(ws, "foo.bar")
+	tr.subscribe(other, "foo.bar")
+	tr.unsubscribe(ws, "foo.bar")
+
+	subs := tr.subscribers("foo.bar")
+	if len(subs) != 1 || subs[0] != other {
+		t.Fatalf("unsubscribe did not remove exactly the targeted subscription, got %v", subs)
+	}
+}
+
+// TestTopicRegistryUnsubscribeAll checks that unsubscribeAll removes every
+// subscription (literal and wildcard) held by a connection across the trie.
+func TestTopicRegistryUnsubscribeAll(t *testing.T) {
+	tr := newTopicRegistry()
+	ws := &websocket.Conn{}
+
+	tr.subscribe(ws, "foo.bar")
+	tr.subscribe(ws, "baz.*")
+	tr.unsubscribeAll(ws)
+
+	if subs := tr.subscribers("foo.bar"); len(subs) != 0 {
+		t.Fatalf("unsubscribeAll left a literal subscription behind: %v", subs)
+	}
+	if subs := tr.subscribers("baz.qux"); len(subs) != 0 {
+		t.Fatalf("unsubscribeAll left a wildcard subscription behind: %v", subs)
+	}
+}
@@ -1,9 +1,14 @@
 package webHandler
 
 import (
+	"errors"
 	"github.com/gorilla/websocket"
 )
 
+// errNoCodec is returned by Transmitter.SendValue when no Codec was
+// supplied to InitWebHandler
+var errNoCodec = errors.New("webHandler: SendValue requires a Codec to be configured in InitWebHandler")
+
 // This structure is provided to the users of the system
 // to send messages back to the websockets
 type Transmitter struct {
@@ -13,20 +18,42 @@ type Transmitter struct {
 	msg []byte
 	mode uint8
 	maxMode uint8
+	msgType int
+	codec Codec
+	//The ClientID of the connection this Transmitter is associated with (if any)
+	id string
+	//The ClientID targeted by SendToClient; only meaningful when mode == Client
+	targetID string
+	//The topic targeted by SendTopic; only meaningful when mode == Topic
+	targetTopic string
+	//The WebHandler this Transmitter was issued by, used by Request to register
+	// and await a response, and by Subscribe/Unsubscribe/SendTopic to reach the
+	// topic registry. Nil for a Transmitter constructed outside the webHandler
+	wh *WebHandler
 }
 
 /*
- * Modes available to the Transmitter to instruct which 
+ * Modes available to the Transmitter to instruct which
  * websockets the transmitter should send messages on
  */
 const (
 	//The order here is essential for proper function of the system
 	// since the check is done by checking the checking the magnitude of the value
-	// I didn't use iota, even though it would work, since it helps clarify that the 
+	// I didn't use iota, even though it would work, since it helps clarify that the
 	// order is important
 	Broadcast = 0
 	Handle    = 1
 	Socket    = 2
+	//Client routes to any/all currently live websocket(s) whose ClientID matches the
+	// target passed to SendToClient, regardless of the handler or socket this
+	// Transmitter is associated with. It is therefore only ever available on the
+	// most permissive Transmitters - see GetModes
+	Client    = 3
+	//Topic routes to every websocket currently subscribed (see Subscribe) to the
+	// topic passed to SendTopic, regardless of the handler or socket this Transmitter
+	// is associated with. Like Client, it is only ever available on the most
+	// permissive Transmitters - see GetModes
+	Topic     = 4
 )
 
 /*
@@ -37,23 +64,37 @@ func (t Transmitter) GetHandler() SocketHandler {
 	return t.sh
 }
 
+/*
+ * Retrieve the ClientID of the websocket connection associated with this transmitter
+ * (if any). See WebHandler.SendTo and Transmitter.SendToClient for sending to a
+ * ClientID directly.
+ * @return {string}
+ */
+func (t Transmitter) GetClientID() string {
+	return t.id
+}
+
 /*
  * Retrieve a list of modess available on this transmitter
  * @return {[]uint8} the list of available codes
  */
 func (t Transmitter) GetModes() []uint8 {
-	if t.maxMode == Socket {
+	if t.maxMode == Topic {
+		return []uint8{Broadcast, Handle, Socket, Client, Topic}
+	} else if t.maxMode == Client {
+		return []uint8{Broadcast, Handle, Socket, Client}
+	} else if t.maxMode == Socket {
 		return []uint8{Broadcast, Handle, Socket}
 	} else if t.maxMode == Handle {
 		return []uint8{Broadcast, Handle}
 	} else /* t.maxMode == Broadcast */ {
-		return []uint8{Broadcast}	
+		return []uint8{Broadcast}
 	}
 }
 
 /*
  * @param data {[]byte}
- * @param mode {uint8} the mode to use for the Transmitter. 
+ * @param mode {uint8} the mode to use for the Transmitter.
  * 			Options are:
  *				Broadcast: Send on all websockets
  *				Handle:   Send only on the websockets connected with the handler attached to this struct (if any)
@@ -61,11 +102,124 @@ func (t Transmitter) GetModes() []uint8 {
  * @returns {bool} whether the transmission occurred. This can fail if an invalid command mode is sent
  */
 func (t Transmitter) Send(data []byte, mode uint8) bool {
+	return t.SendWithType(data, mode, websocket.TextMessage)
+}
+
+/*
+ * Send binary data on the websocket(s) selected by mode. Equivalent to Send,
+ * but the message is written as a websocket.BinaryMessage instead of text.
+ * @param data {[]byte}
+ * @param mode {uint8} the mode to use for the Transmitter, see Send
+ * @returns {bool} whether the transmission occurred. This can fail if an invalid command mode is sent
+ */
+func (t Transmitter) SendBinary(data []byte, mode uint8) bool {
+	return t.SendWithType(data, mode, websocket.BinaryMessage)
+}
+
+/*
+ * Send data on the websocket(s) selected by mode, written as the given websocket message type
+ * @param data {[]byte}
+ * @param mode {uint8} the mode to use for the Transmitter, see Send
+ * @param msgType {int} the websocket message type to write the data as
+ *        (websocket.TextMessage or websocket.BinaryMessage)
+ * @returns {bool} whether the transmission occurred. This can fail if an invalid command mode is sent
+ */
+func (t Transmitter) SendWithType(data []byte, mode uint8, msgType int) bool {
+	//Client requires a target ClientID, so it can only be reached through SendToClient
+	if mode == Client {return false}
+	//Topic requires a target topic, so it can only be reached through SendTopic
+	if mode == Topic {return false}
 	if t.maxMode < mode {return false}
 	if t.wt == nil {return false}
 	var trCopy Transmitter = t
 	trCopy.msg = data
 	trCopy.mode = mode
+	trCopy.msgType = msgType
+	t.wt<- trCopy
+	return true
+}
+
+/*
+ * Send data to any/all currently live websocket(s) whose ClientID matches clientID,
+ * regardless of which handler or socket this Transmitter is associated with.
+ * Requires a Transmitter whose GetModes includes Client.
+ * @param data {[]byte}
+ * @param clientID {string} the ClientID to target, see GetClientID
+ * @returns {bool} whether the transmission occurred. This fails if the Transmitter's
+ *        maxMode is less than Client
+ */
+func (t Transmitter) SendToClient(data []byte, clientID string) bool {
+	if t.maxMode < Client {return false}
+	if t.wt == nil {return false}
+	var trCopy Transmitter = t
+	trCopy.msg = data
+	trCopy.mode = Client
+	trCopy.msgType = websocket.TextMessage
+	trCopy.targetID = clientID
+	t.wt<- trCopy
+	return true
+}
+
+/*
+ * Subscribe this Transmitter's websocket connection to topic, so that a subsequent
+ * SendTopic/WebHandler.Publish targeting topic (including via a matching wildcard
+ * subscription) is delivered to it. Requires a Transmitter associated with a single
+ * websocket connection, i.e. one passed to SocketHandler.Message or
+ * SystemCommander.Message.
+ * @param topic {string} the topic to subscribe to, dot-separated segments. May itself
+ *        contain wildcard segments: "*" matches exactly one segment, "#" matches the
+ *        remainder of a published topic, e.g. "foo.*" or "foo.#"
+ * @return {bool} false if this Transmitter has no associated connection to subscribe
+ */
+func (t Transmitter) Subscribe(topic string) bool {
+	if t.wh == nil || t.ws == nil {return false}
+	t.wh.topics.subscribe(t.ws, topic)
+	return true
+}
+
+/*
+ * Unsubscribe this Transmitter's websocket connection from topic. See Subscribe.
+ * @param topic {string}
+ * @return {bool} false if this Transmitter has no associated connection to unsubscribe
+ */
+func (t Transmitter) Unsubscribe(topic string) bool {
+	if t.wh == nil || t.ws == nil {return false}
+	t.wh.topics.unsubscribe(t.ws, topic)
+	return true
+}
+
+/*
+ * Send data to every currently live websocket subscribed to topic (including via a
+ * matching wildcard subscription, see Subscribe), regardless of the handler or socket
+ * this Transmitter is associated with. Requires a Transmitter whose GetModes includes Topic.
+ * @param data {[]byte}
+ * @param topic {string} the topic to publish on
+ * @return {bool} whether the transmission occurred. This fails if the Transmitter's
+ *        maxMode is less than Topic
+ */
+func (t Transmitter) SendTopic(data []byte, topic string) bool {
+	if t.maxMode < Topic {return false}
+	if t.wt == nil {return false}
+	var trCopy Transmitter = t
+	trCopy.msg = data
+	trCopy.mode = Topic
+	trCopy.msgType = websocket.TextMessage
+	trCopy.targetTopic = topic
 	t.wt<- trCopy
 	return true
+}
+
+/*
+ * Encode v using the Transmitter's Codec and send the result on the websocket(s)
+ * selected by mode. Requires a Codec to have been supplied to InitWebHandler.
+ * @param v {any} the message to encode and send
+ * @param mode {uint8} the mode to use for the Transmitter, see Send
+ * @returns {bool} whether the transmission occurred. This can fail if an invalid command mode is sent
+ * @returns {error} any error that occurred while encoding v, or errNoCodec if no Codec is configured
+ */
+func (t Transmitter) SendValue(v any, mode uint8) (bool, error) {
+	if t.codec == nil {return false, errNoCodec}
+	data, msgType, err := t.codec.Encode(v)
+	if err != nil {return false, err}
+	return t.SendWithType(data, mode, msgType), nil
 }
\ No newline at end of file
@@ -3,6 +3,7 @@
 package webHandler
 
 import(
+	"context"
 	"sync"
 	"net/http"
 	"github.com/gorilla/websocket"
@@ -29,11 +30,13 @@ type SocketHandler interface{
 	Update(tr Transmitter)
 	/*
   	 * Message is called each time a message is received on the associated websocket
-	 * @param m {[]byte} the incoming message from the websocket
+	 * @param m {any} the incoming message. If a Codec was supplied to InitWebHandler,
+	 *        this is the value returned by Codec.Decode; otherwise it is the raw []byte
+	 *        read from the websocket
 	 * @param tr {Transmitter} a Transmitter for sending messages back to the websocket
-	 *        This Transmitter allows Broadcast, Handle, and Socket codes
+	 *        This Transmitter allows Broadcast, Handle, Socket, Client, and Topic codes
 	 */
-	Message(m []byte, tr Transmitter)
+	Message(m any, tr Transmitter)
 }
 
 /* 
@@ -66,14 +69,53 @@ type SystemCommander interface {
 	UpdateFrequency() time.Duration
 	/*
 	 * A timeout for passing incoming message to the control loop. Messages that reach the timeout will be dropped.
-	 * Return a Duration less than or equal to zero to set no timeout 
+	 * Return a Duration less than or equal to zero to set no timeout
 	 * (i.e. no messages will be dropped).
-	 * This value is accessed by the webHandler immediately after the Start method 
+	 * This value is accessed by the webHandler immediately after the Start method
 	 * is called,, at which point it is locked in place and cannot be altered.
 	 * @return {time.Duration}
 	 */
 	MessageTimeout() time.Duration
 	/*
+	 * The interval at which ping control messages are sent on each websocket
+	 * to keep the connection alive and detect half-open connections.
+	 * Return a Duration less than or equal to zero to disable the keepalive
+	 * ping/pong subsystem entirely.
+	 * This value is accessed by the webHandler immediately after the Start method
+	 * is called, at which point it is locked in place and cannot be altered.
+	 * @return {time.Duration}
+	 */
+	PingPeriod() time.Duration
+	/*
+	 * The time to wait for a pong from a websocket before
+	 * the connection is considered dead and closed. This should be comfortably
+	 * longer than PingPeriod, e.g. PingPeriod * 10 / 9, so that a single delayed
+	 * ping does not close a healthy connection. Ignored if PingPeriod is <= 0.
+	 * This value is accessed by the webHandler immediately after the Start method
+	 * is called, at which point it is locked in place and cannot be altered.
+	 * @return {time.Duration}
+	 */
+	PongWait() time.Duration
+	/*
+	 * The deadline allowed for a single write, including ping control messages,
+	 * to complete on a websocket. A write that misses this deadline is treated
+	 * as a dead connection and the websocket is closed.
+	 * This value is accessed by the webHandler immediately after the Start method
+	 * is called, at which point it is locked in place and cannot be altered.
+	 * @return {time.Duration}
+	 */
+	WriteWait() time.Duration
+	/*
+	 * The grace window to retain a disconnected client's outbound message queue under
+	 * its ClientID, so that a reconnect with the same ClientID (e.g. after a network blip)
+	 * resumes delivery instead of starting over. Return a Duration less than or equal to
+	 * zero to drop disconnected clients immediately, with no grace window.
+	 * This value is accessed by the webHandler immediately after the Start method
+	 * is called, at which point it is locked in place and cannot be altered.
+	 * @return {time.Duration}
+	 */
+	ReconnectGrace() time.Duration
+	/*
      * Update is called during every iteration of the control loop
 	 * @param tr {Transmitter} a transmitter for sending messages back to the desired websockets
 	 *        This Transmitter only allows the Broadcast code
@@ -81,10 +123,41 @@ type SystemCommander interface {
 	Update(tr Transmitter)
 	/*
  	 * Message is called every time a message is received on any websocket associated with the system
+	 * @param m {any} the incoming message. If a Codec was supplied to InitWebHandler,
+	 *        this is the value returned by Codec.Decode; otherwise it is the raw []byte
+	 *        read from the websocket
 	 * @param tr {Transmitter} a transmitter for sending messages back to the desired websockets
-	 *        This Transmitter allows the Broadcast, Handle, and Socket codes
+	 *        This Transmitter allows the Broadcast, Handle, Socket, Client, and Topic codes
 	 */
-	Message(m []byte,sh SocketHandler, tr Transmitter)
+	Message(m any,sh SocketHandler, tr Transmitter)
+}
+
+/*
+ * Codec lets messages be encoded to and decoded from the raw bytes sent over a
+ * websocket, so a SocketHandler can work with typed message structs (e.g. JSON
+ * or Protobuf) instead of hand-rolling parsing of []byte. Supplied to
+ * InitWebHandler; a nil Codec leaves messages as raw []byte, as before.
+ */
+type Codec interface {
+	/*
+	 * Encode a message into the bytes that should be written to a websocket
+	 * @param v {any} the message to encode
+	 * @return {[]byte} the encoded bytes
+	 * @return {int} the websocket message type the bytes should be sent as
+	 *        (websocket.TextMessage or websocket.BinaryMessage)
+	 * @return {error} any error that occurred while encoding v
+	 */
+	Encode(v any) ([]byte, int, error)
+	/*
+	 * Decode bytes received from a websocket into a message
+	 * @param data {[]byte} the raw bytes read from the websocket
+	 * @param msgType {int} the websocket message type the bytes were received as
+	 * @return {any} the decoded message, delivered to SocketHandler.Message and
+	 *        SystemCommander.Message
+	 * @return {error} any error that occurred while decoding data. A decode error
+	 *        drops the message rather than delivering it to the handlers
+	 */
+	Decode(data []byte, msgType int) (any, error)
 }
 
 /*
@@ -95,27 +168,57 @@ type SystemCommander interface {
  * establishing websocket connections
  */
 type WebHandler struct {
-	//Channels for terminating the receiver and transmitter go routines
-	exitReceive chan struct{}
-	exitTransmit chan struct{}
+	//The internal context for the webHandler. Cancelled by Shutdown (or by the
+	// cancellation of the parent context passed to InitWebHandler), this signals
+	// every go routine (the receive loop, the transmit dispatcher, the per-connection
+	// readers and writers) to exit.
+	ctx    context.Context
+	cancel context.CancelFunc
+	//Guards Shutdown so that it may safely be called more than once
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	//Signalled once the receive loop's go routine has called SystemCommander.Stop and exited
 	finishedExit chan struct{}
-	doneConn chan struct{}
-	
+
 	//The upgrader for upgrading websockets
 	upgrader websocket.Upgrader
 	//A waitGroup for synching closing all of the connections
 	wsWG sync.WaitGroup
-	//A mutex for preventing concurrent accesses to the client map
-	clientLock sync.Mutex
-	
+	//A read/write mutex for preventing concurrent accesses to the client map.
+	// The dispatcher in handleWebsocketSend only needs to read the map to fan out
+	// a message, so it takes a read lock; registering or dropping a connection
+	// takes the write lock.
+	clientLock sync.RWMutex
+
 	//The receiver and transmitter channels
 	// These have queues to help maintain order in message transmission
 	webReceive chan  *cmdStruct
-	webTransmit chan Transmitter  
-	
-	//The map for all websocket connections. The byte value indicates the type of data transmitted over this connection.
-	clients map[*websocket.Conn] SocketHandler
-	
+	webTransmit chan Transmitter
+
+	//The map for all websocket connections. Each client owns a buffered outbound
+	// channel and a writer go routine so that one slow connection cannot stall
+	// writes to any of the others.
+	clients map[*websocket.Conn] *client
+
+	//Retains the outbound channel (and any queued backlog) of a recently disconnected
+	// client, keyed by ClientID, for up to ReconnectGrace so a reconnect with the same
+	// ClientID resumes delivery instead of starting over
+	pending map[string] *client
+
 	//The map of the functions available for separate websockets
 	wFuncs WebFuncs
+
+	//The Codec used to encode/decode messages, or nil to leave messages as raw []byte
+	codec Codec
+
+	//The id to assign to the next Transmitter.Request call
+	nextRequestID uint64
+	//Response channels for in-flight Transmitter.Request calls, keyed by request id.
+	// Populated by Request and consumed by tryDeliverResponse
+	pendingRequests sync.Map
+
+	//The trie of topic subscriptions used by Transmitter.Subscribe/Unsubscribe/SendTopic
+	// and WebHandler.Publish
+	topics *topicRegistry
 }